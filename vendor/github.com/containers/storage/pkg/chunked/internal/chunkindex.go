@@ -0,0 +1,82 @@
+package internal
+
+// NOTE: This is used from github.com/containers/image by callers that
+// don't otherwise use containers/storage, so don't make this depend on any
+// larger software like the graph drivers.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+)
+
+// ChunkIndexEntry records the size of a previously-seen chunk, so a later build that emits the
+// same bytes again can skip writing them. It does not record which layer the chunk came from.
+type ChunkIndexEntry struct {
+	Size int64 `json:"size"`
+}
+
+// ChunkIndex maps chunk digests (as produced by chunkDigestHex) to the size of the chunk, so that
+// NewZstdChunkedWriter can tell whether a content-defined chunk it is about to write was already
+// emitted by a previous layer. It is safe for concurrent use.
+//
+// A ChunkIndex is meant to be persisted between builds (e.g. alongside a build cache) and loaded
+// back with LoadChunkIndex before writing the next layer of the same image.
+type ChunkIndex struct {
+	mu      sync.Mutex
+	entries map[string]ChunkIndexEntry
+}
+
+// NewChunkIndex returns an empty ChunkIndex.
+func NewChunkIndex() *ChunkIndex {
+	return &ChunkIndex{entries: map[string]ChunkIndexEntry{}}
+}
+
+// LoadChunkIndex parses a ChunkIndex previously serialized with Marshal.
+func LoadChunkIndex(data []byte) (*ChunkIndex, error) {
+	entries := map[string]ChunkIndexEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return &ChunkIndex{entries: entries}, nil
+}
+
+// Marshal serializes the index so it can be persisted and reloaded with LoadChunkIndex.
+func (c *ChunkIndex) Marshal() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return json.Marshal(c.entries)
+}
+
+// Lookup reports whether chunk's content digest is already present in the index, returning the
+// digest (in the same "sha256:<hex>" form stored in FileMetadata.ChunkDigest) either way so the
+// caller doesn't need to hash the chunk twice.
+func (c *ChunkIndex) Lookup(chunk []byte) (digest string, found bool) {
+	digest = chunkDigestHex(chunk)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, found = c.entries[digest]
+	return digest, found
+}
+
+// add records that digest (as returned by Lookup) identifies a chunk of the given size. It is
+// called by NewZstdChunkedWriter once a build has finished successfully, for every chunk it
+// wrote, so that later builds of the same image can dedup against it. Chunks must not become
+// dedup-able against an index entry added during the very build that's still using it: Lookup
+// is consulted while splitting the tar stream, so adding entries before Close succeeds would let
+// a build dedup a chunk against an identical chunk emitted earlier in the same blob, even though
+// that earlier chunk's bytes only exist in this in-progress build and nowhere a ChunkStore could
+// resolve them from.
+func (c *ChunkIndex) add(digest string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[digest] = ChunkIndexEntry{Size: size}
+}
+
+// chunkDigestHex returns the "sha256:<hex>" digest used to key chunks both in FileMetadata and in
+// ChunkIndex.
+func chunkDigestHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
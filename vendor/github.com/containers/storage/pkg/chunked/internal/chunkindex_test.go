@@ -0,0 +1,60 @@
+package internal
+
+import "testing"
+
+func TestChunkIndexAddLookup(t *testing.T) {
+	idx := NewChunkIndex()
+
+	chunk := []byte("some chunk content")
+	dig, found := idx.Lookup(chunk)
+	if found {
+		t.Fatal("Lookup found a chunk before it was added")
+	}
+	if dig == "" {
+		t.Fatal("Lookup did not return a digest even on a miss")
+	}
+
+	idx.add(dig, int64(len(chunk)))
+
+	gotDigest, found := idx.Lookup(chunk)
+	if !found {
+		t.Fatal("Lookup did not find a chunk that was added")
+	}
+	if gotDigest != dig {
+		t.Fatalf("Lookup returned a different digest for the same chunk: got %s, want %s", gotDigest, dig)
+	}
+}
+
+func TestChunkIndexMarshalLoadRoundTrip(t *testing.T) {
+	idx := NewChunkIndex()
+	chunk := []byte("some other chunk content")
+	dig, _ := idx.Lookup(chunk)
+	idx.add(dig, int64(len(chunk)))
+
+	data, err := idx.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	reloaded, err := LoadChunkIndex(data)
+	if err != nil {
+		t.Fatalf("LoadChunkIndex: %v", err)
+	}
+
+	gotDigest, found := reloaded.Lookup(chunk)
+	if !found {
+		t.Fatal("reloaded index lost a chunk added before Marshal")
+	}
+	if gotDigest != dig {
+		t.Fatalf("reloaded index returned a different digest: got %s, want %s", gotDigest, dig)
+	}
+}
+
+func TestChunkIndexLookupMissUnrelatedChunk(t *testing.T) {
+	idx := NewChunkIndex()
+	idx.add(chunkDigestHex([]byte("a")), 1)
+
+	if _, found := idx.Lookup([]byte("b")); found {
+		t.Fatal("Lookup reported a hit for a chunk that was never added")
+	}
+}
@@ -45,11 +45,23 @@ type FileMetadata struct {
 	ChunkOffset int64  `json:"chunkOffset,omitempty"`
 	ChunkDigest string `json:"chunkDigest,omitempty"`
 	ChunkType   string `json:"chunkType,omitempty"`
+
+	// EncNonce and EncTag are only set when the chunk was written by the encrypted
+	// zstd:chunked variant: EncNonce is the per-chunk AEAD nonce and EncTag is the
+	// authentication tag produced when sealing the chunk. See encryption.go.
+	EncNonce []byte `json:"encNonce,omitempty"`
+	EncTag   []byte `json:"encTag,omitempty"`
 }
 
 const (
 	ChunkTypeData  = ""
 	ChunkTypeZeros = "zeros"
+
+	// ChunkTypeDedup marks a chunk whose bytes were already present in a ChunkIndex from a
+	// previous layer: the TOC records only ChunkDigest/ChunkSize, and the chunk's bytes are
+	// not written to this blob at all. A differ must resolve it through a ChunkStore rather
+	// than reading from the blob.
+	ChunkTypeDedup = "dedup"
 )
 
 const (
@@ -213,6 +225,11 @@ type ZstdChunkedFooterData struct {
 	LengthCompressedTarSplit   uint64
 	LengthUncompressedTarSplit uint64
 	ChecksumAnnotationTarSplit string // Only used when reading a layer, not when creating it
+
+	// Flags holds the bits described by the Flag* constants in encryption.go. It is packed
+	// into the upper 32 bits of the on-disk ManifestType word, since ManifestType itself only
+	// ever uses a handful of low values.
+	Flags uint64
 }
 
 func footerDataToBlob(footer ZstdChunkedFooterData) []byte {
@@ -221,7 +238,7 @@ func footerDataToBlob(footer ZstdChunkedFooterData) []byte {
 	binary.LittleEndian.PutUint64(manifestDataLE[8*0:], footer.Offset)
 	binary.LittleEndian.PutUint64(manifestDataLE[8*1:], footer.LengthCompressed)
 	binary.LittleEndian.PutUint64(manifestDataLE[8*2:], footer.LengthUncompressed)
-	binary.LittleEndian.PutUint64(manifestDataLE[8*3:], footer.ManifestType)
+	binary.LittleEndian.PutUint64(manifestDataLE[8*3:], footer.ManifestType|(footer.Flags<<32))
 	binary.LittleEndian.PutUint64(manifestDataLE[8*4:], footer.OffsetTarSplit)
 	binary.LittleEndian.PutUint64(manifestDataLE[8*5:], footer.LengthCompressedTarSplit)
 	binary.LittleEndian.PutUint64(manifestDataLE[8*6:], footer.LengthUncompressedTarSplit)
@@ -264,7 +281,9 @@ func ReadFooterDataFromBlob(footer []byte) (ZstdChunkedFooterData, error) {
 	footerData.Offset = binary.LittleEndian.Uint64(footer[0:8])
 	footerData.LengthCompressed = binary.LittleEndian.Uint64(footer[8:16])
 	footerData.LengthUncompressed = binary.LittleEndian.Uint64(footer[16:24])
-	footerData.ManifestType = binary.LittleEndian.Uint64(footer[24:32])
+	manifestTypeAndFlags := binary.LittleEndian.Uint64(footer[24:32])
+	footerData.ManifestType = manifestTypeAndFlags & 0xffffffff
+	footerData.Flags = manifestTypeAndFlags >> 32
 	footerData.OffsetTarSplit = binary.LittleEndian.Uint64(footer[32:40])
 	footerData.LengthCompressedTarSplit = binary.LittleEndian.Uint64(footer[40:48])
 	footerData.LengthUncompressedTarSplit = binary.LittleEndian.Uint64(footer[48:56])
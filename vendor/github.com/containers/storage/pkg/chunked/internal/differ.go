@@ -0,0 +1,204 @@
+package internal
+
+// NOTE: This is used from github.com/containers/image by callers that
+// don't otherwise use containers/storage, so don't make this depend on any
+// larger software like the graph drivers.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// ChunkStore lets a Differ locate the on-disk contents of a chunk that was already applied by a
+// previous layer, so that ApplyDiff can copy it in instead of re-downloading it.
+type ChunkStore interface {
+	// Lookup returns the path to a file containing the bytes for the chunk identified by
+	// digest, and whether it was found.
+	Lookup(digest string) (path string, ok bool)
+}
+
+// DifferOutput is the result of a successful ApplyDiff.
+type DifferOutput struct {
+	// UncompressedDigest is the digest of the concatenated decompressed regular-file content
+	// extracted from the blob, in TOC order. It is NOT a byte-exact digest of the original tar
+	// stream (tar headers are not reconstructed), so it is only useful to detect whether two
+	// applications of the same blob produced identical file content, not to validate against a
+	// config's DiffID.
+	UncompressedDigest digest.Digest
+
+	// UIDs and GIDs are the sets of numeric owners observed while applying the diff, so the
+	// storage layer can validate or remap them.
+	UIDs []int
+	GIDs []int
+
+	// BigData holds the serialized TOC and tar-split data that the storage layer should
+	// persist as layer metadata, keyed by the same names used by pkg/chunked's own Differ.
+	// The default Differ returned by NewDiffer does not fill it in and leaves it nil.
+	BigData map[string][]byte
+}
+
+// Differ streams a zstd:chunked blob through a chunk-aware applier, reusing chunks already
+// present in chunkStore when possible rather than extracting every chunk from blob.
+type Differ interface {
+	// ApplyDiff applies the contents described by toc to dest. blob must be positioned at the
+	// start of the same compressed chunk stream that toc's ChunkOffset/EndOffset entries were
+	// recorded against (i.e. the blob written by NewZstdChunkedWriter, read sequentially in TOC
+	// order), since only ChunkTypeDedup and ChunkTypeZeros entries have no bytes in it; every
+	// other chunk's bytes are consumed from it, even when chunkStore resolves that chunk.
+	ApplyDiff(dest string, blob io.Reader, toc *TOC, chunkStore ChunkStore) (DifferOutput, error)
+}
+
+// chunkedDiffer is the default Differ implementation: it extracts every TypeReg/TypeChunk entry
+// in toc, preferring a copy from chunkStore over reading the bytes from blob whenever the
+// chunk's digest is already present there.
+type chunkedDiffer struct{}
+
+// NewDiffer returns the default chunk-aware Differ.
+func NewDiffer() Differ {
+	return &chunkedDiffer{}
+}
+
+func (c *chunkedDiffer) ApplyDiff(dest string, blob io.Reader, toc *TOC, chunkStore ChunkStore) (DifferOutput, error) {
+	var output DifferOutput
+	uidSet := map[int]struct{}{}
+	gidSet := map[int]struct{}{}
+
+	digester := digest.Canonical.Digester()
+
+	for _, entry := range toc.Entries {
+		uidSet[entry.UID] = struct{}{}
+		gidSet[entry.GID] = struct{}{}
+
+		switch entry.Type {
+		case TypeDir:
+			if err := os.MkdirAll(filepath.Join(dest, entry.Name), os.FileMode(entry.Mode)); err != nil {
+				return output, err
+			}
+		case TypeReg, TypeChunk:
+			if err := c.applyFile(dest, entry, blob, chunkStore, digester.Hash()); err != nil {
+				return output, err
+			}
+		case TypeSymlink:
+			if err := os.Symlink(entry.Linkname, filepath.Join(dest, entry.Name)); err != nil {
+				return output, err
+			}
+		case TypeLink:
+			if err := os.Link(filepath.Join(dest, entry.Linkname), filepath.Join(dest, entry.Name)); err != nil {
+				return output, err
+			}
+		}
+	}
+
+	output.UncompressedDigest = digester.Digest()
+	for uid := range uidSet {
+		output.UIDs = append(output.UIDs, uid)
+	}
+	for gid := range gidSet {
+		output.GIDs = append(output.GIDs, gid)
+	}
+	return output, nil
+}
+
+// applyFile writes the decompressed content of a single regular-file chunk to dest, reusing
+// chunkStore's copy when the chunk's digest is already known to it instead of consuming bytes
+// from blob. Every byte written to the target file is also written to digestSink, so the caller
+// can accumulate a digest over the reconstructed content. Chunks belonging to the same file are
+// appended in the order they appear in the TOC, since a multi-chunk file produces one TOC entry
+// per chunk.
+func (c *chunkedDiffer) applyFile(dest string, entry FileMetadata, blob io.Reader, chunkStore ChunkStore, digestSink io.Writer) error {
+	target := filepath.Join(dest, entry.Name)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	if entry.ChunkDigest != "" && chunkStore != nil {
+		if path, ok := chunkStore.Lookup(entry.ChunkDigest); ok {
+			// The blob still physically contains this chunk's compressed bytes unless it was
+			// deduplicated at write time (ChunkTypeDedup) or is all zeros (ChunkTypeZeros):
+			// chunkStore only changes where the bytes are sourced from, not blob's stream
+			// position, so they must be discarded here or every chunk after this one desyncs.
+			if entry.ChunkType != ChunkTypeDedup && entry.ChunkType != ChunkTypeZeros {
+				compressedSize := entryCompressedEndOffset(entry) - entryCompressedOffset(entry)
+				if compressedSize > 0 {
+					if _, err := io.CopyN(io.Discard, blob, compressedSize); err != nil {
+						return fmt.Errorf("discarding chunk %q already resolved via chunkStore: %w", entry.Name, err)
+					}
+				}
+			}
+
+			in, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.FileMode(entry.Mode))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			_, err = io.Copy(io.MultiWriter(f, digestSink), in)
+			return err
+		}
+	}
+
+	if entry.ChunkType == ChunkTypeDedup {
+		// This chunk's bytes were never written to the blob (writer.go's ChunkIndex dedup
+		// path): it can only be resolved through chunkStore, so reaching here with a miss
+		// above is fatal. Falling through would read entry.ChunkSize bytes belonging to the
+		// next real chunk out of blob and silently corrupt every file after this one.
+		return fmt.Errorf("chunk %q (digest %s) was deduplicated against a prior layer not present in chunkStore", entry.Name, entry.ChunkDigest)
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.FileMode(entry.Mode))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	out := io.MultiWriter(f, digestSink)
+
+	if entry.ChunkType == ChunkTypeZeros {
+		_, err := io.CopyN(out, zeroReader{}, entry.ChunkSize)
+		return err
+	}
+
+	// An empty regular file is recorded as a plain TypeReg entry with no data in the blob.
+	if entry.Type == TypeReg && entry.Size == 0 {
+		return nil
+	}
+
+	compressedSize := entryCompressedEndOffset(entry) - entryCompressedOffset(entry)
+	if compressedSize <= 0 {
+		return fmt.Errorf("chunk %q has no compressed data recorded in the TOC and was not found in chunkStore", entry.Name)
+	}
+
+	compressed := io.LimitReader(blob, compressedSize)
+	zr, err := zstd.NewReader(compressed)
+	if err != nil {
+		return fmt.Errorf("creating zstd decoder for %q: %w", entry.Name, err)
+	}
+	defer zr.Close()
+
+	if _, err := io.Copy(out, zr); err != nil {
+		return fmt.Errorf("decompressing %q: %w", entry.Name, err)
+	}
+	return nil
+}
+
+// zeroReader is an io.Reader that produces an endless stream of zero bytes, used to materialize
+// ChunkTypeZeros chunks (which have no bytes in the blob at all) without a special-cased loop.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
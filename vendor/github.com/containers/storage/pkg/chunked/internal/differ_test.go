@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type noopChunkStore struct{}
+
+func (noopChunkStore) Lookup(string) (string, bool) { return "", false }
+
+// mapChunkStore resolves a digest to a path via a plain map, for tests that want a ChunkStore hit.
+type mapChunkStore map[string]string
+
+func (m mapChunkStore) Lookup(digest string) (string, bool) {
+	path, ok := m[digest]
+	return path, ok
+}
+
+func TestChunkedDifferApplyDiffDecompressesChunks(t *testing.T) {
+	fileA := bytes.Repeat([]byte("A"), 200*1024)
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	if err := tw.WriteHeader(&tar.Header{Name: "fileA", Typeflag: tar.TypeReg, Size: int64(len(fileA)), Mode: 0o644}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(fileA); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var blob bytes.Buffer
+	w := NewZstdChunkedWriter(&blob, WriterOptions{ChunkMinSize: 16 * 1024, ChunkAvgSize: 32 * 1024, ChunkMaxSize: 48 * 1024})
+	if _, err := w.Write(tarBuf.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	metadata := w.Metadata()
+	var chunkCount int
+	for _, e := range metadata {
+		if e.Type == TypeChunk {
+			chunkCount++
+		}
+	}
+	if chunkCount < 2 {
+		t.Fatalf("expected at least 2 chunks, got %d", chunkCount)
+	}
+
+	dest := t.TempDir()
+	differ := NewDiffer()
+	out, err := differ.ApplyDiff(dest, bytes.NewReader(blob.Bytes()), &TOC{Version: 1, Entries: metadata}, noopChunkStore{})
+	if err != nil {
+		t.Fatalf("ApplyDiff: %v", err)
+	}
+	if out.UncompressedDigest == "" {
+		t.Fatal("ApplyDiff did not record an UncompressedDigest")
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "fileA"))
+	if err != nil {
+		t.Fatalf("reading extracted file: %v", err)
+	}
+	if !bytes.Equal(got, fileA) {
+		t.Fatalf("extracted content mismatch: got %d bytes, want %d bytes", len(got), len(fileA))
+	}
+}
+
+// TestChunkedDifferApplyDiffChunkStoreHitStaysAligned checks that resolving one chunk of a
+// multi-chunk file through chunkStore doesn't desync the blob for the chunks that follow, and
+// that the chunkStore bytes are appended rather than overwriting earlier chunks of the same file.
+func TestChunkedDifferApplyDiffChunkStoreHitStaysAligned(t *testing.T) {
+	fileA := bytes.Repeat([]byte("A"), 200*1024)
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	if err := tw.WriteHeader(&tar.Header{Name: "fileA", Typeflag: tar.TypeReg, Size: int64(len(fileA)), Mode: 0o644}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(fileA); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var blob bytes.Buffer
+	w := NewZstdChunkedWriter(&blob, WriterOptions{ChunkMinSize: 16 * 1024, ChunkAvgSize: 32 * 1024, ChunkMaxSize: 48 * 1024})
+	if _, err := w.Write(tarBuf.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	metadata := w.Metadata()
+	var chunkIdx = -1
+	for i, e := range metadata {
+		if e.Type == TypeChunk {
+			chunkIdx = i
+			break
+		}
+	}
+	if chunkIdx < 0 {
+		t.Fatal("expected at least one chunk")
+	}
+
+	// Materialize the first chunk's plaintext bytes on disk, as a ChunkStore would, and point
+	// the store at it by digest so ApplyDiff resolves that one chunk without reading it from
+	// the blob.
+	storeDir := t.TempDir()
+	storedChunkPath := filepath.Join(storeDir, "chunk0")
+	chunkStart := metadata[chunkIdx].ChunkOffset
+	chunkLen := metadata[chunkIdx].ChunkSize
+	if err := os.WriteFile(storedChunkPath, fileA[chunkStart:chunkStart+chunkLen], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store := mapChunkStore{metadata[chunkIdx].ChunkDigest: storedChunkPath}
+
+	dest := t.TempDir()
+	differ := NewDiffer()
+	out, err := differ.ApplyDiff(dest, bytes.NewReader(blob.Bytes()), &TOC{Version: 1, Entries: metadata}, store)
+	if err != nil {
+		t.Fatalf("ApplyDiff: %v", err)
+	}
+	if out.UncompressedDigest == "" {
+		t.Fatal("ApplyDiff did not record an UncompressedDigest")
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "fileA"))
+	if err != nil {
+		t.Fatalf("reading extracted file: %v", err)
+	}
+	if !bytes.Equal(got, fileA) {
+		t.Fatalf("extracted content mismatch: got %d bytes, want %d bytes", len(got), len(fileA))
+	}
+}
+
+// TestChunkedDifferRejectsUnresolvedDedupChunk checks that a chunk deduplicated against a
+// ChunkIndex (and therefore absent from the blob) fails loudly when chunkStore can't resolve it,
+// instead of silently reading a neighboring chunk's bytes out of the blob.
+func TestChunkedDifferRejectsUnresolvedDedupChunk(t *testing.T) {
+	metadata := []FileMetadata{
+		{Type: TypeChunk, Name: "fileA", ChunkSize: 4, ChunkDigest: "sha256:deadbeef", ChunkType: ChunkTypeDedup},
+	}
+
+	dest := t.TempDir()
+	differ := NewDiffer()
+	_, err := differ.ApplyDiff(dest, bytes.NewReader(nil), &TOC{Version: 1, Entries: metadata}, noopChunkStore{})
+	if err == nil {
+		t.Fatal("expected ApplyDiff to fail for a deduplicated chunk missing from chunkStore, got nil error")
+	}
+}
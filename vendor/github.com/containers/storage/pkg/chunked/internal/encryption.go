@@ -0,0 +1,222 @@
+package internal
+
+// NOTE: This is used from github.com/containers/image by callers that
+// don't otherwise use containers/storage, so don't make this depend on any
+// larger software like the graph drivers.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// FlagEncryptedAESGCM marks a zstd:chunked blob whose chunks and manifest are sealed with
+	// AES-256-GCM. It is stored in ZstdChunkedFooterData.Flags.
+	FlagEncryptedAESGCM uint64 = 1 << 0
+
+	// encNonceSize is the size, in bytes, of the per-chunk deterministic nonce. It must fit
+	// the 12-byte nonce required by cipher.AEAD implementations once the chunk offset is
+	// folded in.
+	encNonceSize = 12
+)
+
+// contentEncryptionKeySize is the key size, in bytes, for AES-256-GCM.
+const contentEncryptionKeySize = 32
+
+// sealChunk encrypts plain with cek using AES-256-GCM, deriving the nonce from the chunk's
+// offset so that no two chunks in the same layer ever reuse a nonce for the same key. It returns
+// the ciphertext (with the GCM tag appended, as Seal normally does) split into the opaque blob
+// to write to the destination and the tag/nonce to record in FileMetadata for the reader.
+func sealChunk(cek []byte, offset int64, plain []byte) (sealed []byte, nonce []byte, tag []byte, err error) {
+	aead, err := newAEAD(cek)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	nonce = nonceFromOffset(offset)
+	out := aead.Seal(nil, nonce, plain, nil)
+
+	tagSize := aead.Overhead()
+	sealed = out[:len(out)-tagSize]
+	tag = out[len(out)-tagSize:]
+	return sealed, nonce, tag, nil
+}
+
+// openChunk decrypts a chunk previously produced by sealChunk.
+func openChunk(cek []byte, nonce, tag, sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(cek)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := append(append([]byte{}, sealed...), tag...)
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func newAEAD(cek []byte) (cipher.AEAD, error) {
+	if len(cek) != contentEncryptionKeySize {
+		return nil, fmt.Errorf("invalid content encryption key size %d, expected %d", len(cek), contentEncryptionKeySize)
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonceFromOffset derives a 12-byte AEAD nonce from a chunk's offset within the plaintext blob,
+// so that the nonce never needs to be stored alongside the ciphertext for a given (cek, offset)
+// pair. It is still recorded in FileMetadata.EncNonce so readers don't need to reconstruct the
+// full chunk layout just to decrypt one chunk.
+func nonceFromOffset(offset int64) []byte {
+	nonce := make([]byte, encNonceSize)
+	binary.LittleEndian.PutUint64(nonce[0:8], uint64(offset))
+	return nonce
+}
+
+// GenerateContentEncryptionKey returns a new random 256-bit content encryption key, suitable for
+// use with WriteEncryptedZstdChunkedManifest. Wrapping this key for recipients (PGP, JWE, PKCS7)
+// is the caller's responsibility, via the existing ocicrypt annotations on the image manifest.
+func GenerateContentEncryptionKey() ([]byte, error) {
+	cek := make([]byte, contentEncryptionKeySize)
+	if _, err := io.ReadFull(rand.Reader, cek); err != nil {
+		return nil, err
+	}
+	return cek, nil
+}
+
+// WriteEncryptedZstdChunkedManifest is the encrypted counterpart of WriteZstdChunkedManifest: the
+// manifest itself is sealed with cek, and outMetadata is annotated so a reader that holds cek can
+// locate and decrypt it. Individual chunks are sealed separately, by ZstdChunkedWriter when
+// WriterOptions.ContentEncryptionKey is set, so that partial pulls can fetch and decrypt single
+// chunks without downloading the whole blob.
+func WriteEncryptedZstdChunkedManifest(dest io.Writer, outMetadata map[string]string, offset uint64, tarSplitData *TarSplitData, metadata []FileMetadata, level int, cek []byte) error {
+	const zstdSkippableFrameHeader = 8
+	manifestOffset := offset + zstdSkippableFrameHeader
+
+	toc := TOC{
+		Version: 1,
+		Entries: metadata,
+	}
+
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	manifest, err := json.Marshal(toc)
+	if err != nil {
+		return err
+	}
+
+	var compressedBuffer bytes.Buffer
+	zstdWriter, err := ZstdWriterWithLevel(&compressedBuffer, level)
+	if err != nil {
+		return err
+	}
+	if _, err := zstdWriter.Write(manifest); err != nil {
+		zstdWriter.Close()
+		return err
+	}
+	if err := zstdWriter.Close(); err != nil {
+		return err
+	}
+
+	sealedManifest, manifestNonce, manifestTag, err := sealChunk(cek, int64(manifestOffset), compressedBuffer.Bytes())
+	if err != nil {
+		return err
+	}
+	compressedManifest := append(sealedManifest, manifestTag...)
+
+	outMetadata[ManifestInfoKey] = fmt.Sprintf("%d:%d:%d:%d", manifestOffset, len(compressedManifest), len(manifest), ManifestTypeCRFS)
+	outMetadata[EncryptionNonceKey] = fmt.Sprintf("%x", manifestNonce)
+	if err := appendZstdSkippableFrame(dest, compressedManifest); err != nil {
+		return err
+	}
+
+	outMetadata[TarSplitChecksumKey] = tarSplitData.Digest.String()
+	tarSplitOffset := manifestOffset + uint64(len(compressedManifest)) + zstdSkippableFrameHeader
+	outMetadata[TarSplitInfoKey] = fmt.Sprintf("%d:%d:%d", tarSplitOffset, len(tarSplitData.Data), tarSplitData.UncompressedSize)
+	if err := appendZstdSkippableFrame(dest, tarSplitData.Data); err != nil {
+		return err
+	}
+
+	footer := ZstdChunkedFooterData{
+		ManifestType:               uint64(ManifestTypeCRFS),
+		Offset:                     manifestOffset,
+		LengthCompressed:           uint64(len(compressedManifest)),
+		LengthUncompressed:         uint64(len(manifest)),
+		OffsetTarSplit:             tarSplitOffset,
+		LengthCompressedTarSplit:   uint64(len(tarSplitData.Data)),
+		LengthUncompressedTarSplit: uint64(tarSplitData.UncompressedSize),
+		Flags:                      FlagEncryptedAESGCM,
+	}
+
+	return appendZstdSkippableFrame(dest, footerDataToBlob(footer))
+}
+
+// EncryptionNonceKey is the annotation holding the hex-encoded nonce used to seal the manifest,
+// alongside the existing ManifestInfoKey annotation. WriteEncryptedZstdChunkedManifest does not
+// set ManifestChecksumKey.
+const EncryptionNonceKey = "io.github.containers.zstd-chunked.manifest-encryption-nonce"
+
+// ErrMissingContentEncryptionKey is returned when an encrypted blob is read without a CEK.
+var ErrMissingContentEncryptionKey = errors.New("zstd:chunked blob is encrypted but no content encryption key was provided")
+
+// ReadEncryptedZstdChunkedManifest is the decrypt counterpart of WriteEncryptedZstdChunkedManifest:
+// it reads the footer of the blob exposed through ra, verifies FlagEncryptedAESGCM is set, and
+// unseals and decompresses the manifest with cek, returning the parsed TOC.
+func ReadEncryptedZstdChunkedManifest(ra io.ReaderAt, size int64, cek []byte) (*TOC, error) {
+	if size < FooterSizeSupported {
+		return nil, errors.New("blob too small to contain a zstd:chunked footer")
+	}
+
+	footerBytes := make([]byte, FooterSizeSupported)
+	if _, err := ra.ReadAt(footerBytes, size-FooterSizeSupported); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading zstd:chunked footer: %w", err)
+	}
+	footer, err := ReadFooterDataFromBlob(footerBytes)
+	if err != nil {
+		return nil, err
+	}
+	if footer.Flags&FlagEncryptedAESGCM == 0 {
+		return nil, errors.New("blob is not marked as encrypted in its footer")
+	}
+
+	aead, err := newAEAD(cek)
+	if err != nil {
+		return nil, err
+	}
+	tagSize := aead.Overhead()
+
+	sealedAndTag := make([]byte, footer.LengthCompressed)
+	if _, err := ra.ReadAt(sealedAndTag, int64(footer.Offset)); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading encrypted zstd:chunked manifest: %w", err)
+	}
+	if len(sealedAndTag) < tagSize {
+		return nil, errors.New("encrypted manifest shorter than one AEAD tag")
+	}
+	sealed := sealedAndTag[:len(sealedAndTag)-tagSize]
+	tag := sealedAndTag[len(sealedAndTag)-tagSize:]
+
+	nonce := nonceFromOffset(int64(footer.Offset))
+	compressedManifest, err := openChunk(cek, nonce, tag, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting zstd:chunked manifest: %w", err)
+	}
+
+	manifest, err := decompressFrame(compressedManifest, int64(footer.LengthUncompressed))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing zstd:chunked manifest: %w", err)
+	}
+
+	var toc TOC
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	if err := json.Unmarshal(manifest, &toc); err != nil {
+		return nil, fmt.Errorf("parsing zstd:chunked TOC: %w", err)
+	}
+	return &toc, nil
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// TestEncryptedChunkRoundTrip writes a blob whose chunks are sealed with a content encryption
+// key and whose manifest is sealed separately, then reads both back with the same key.
+func TestEncryptedChunkRoundTrip(t *testing.T) {
+	cek, err := GenerateContentEncryptionKey()
+	if err != nil {
+		t.Fatalf("GenerateContentEncryptionKey: %v", err)
+	}
+
+	fileA := bytes.Repeat([]byte("A"), 200*1024)
+	tarStream := buildTar(t, map[string][]byte{"fileA": fileA})
+
+	var blob bytes.Buffer
+	w := NewZstdChunkedWriter(&blob, WriterOptions{
+		ChunkMinSize:         16 * 1024,
+		ChunkAvgSize:         32 * 1024,
+		ChunkMaxSize:         48 * 1024,
+		ContentEncryptionKey: cek,
+	})
+	if _, err := w.Write(tarStream); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	metadata := w.Metadata()
+	var sealedCount int
+	for _, e := range metadata {
+		if e.Type == TypeChunk && e.ChunkType != ChunkTypeZeros {
+			if len(e.EncTag) == 0 {
+				t.Fatalf("chunk %q was not sealed: EncTag is empty", e.Name)
+			}
+			sealedCount++
+		}
+	}
+	if sealedCount == 0 {
+		t.Fatal("expected at least one sealed chunk")
+	}
+
+	outMetadata := map[string]string{}
+	tarSplit := &TarSplitData{Data: []byte{}, Digest: digest.Digest("sha256:" + strings.Repeat("0", 64))}
+	if err := WriteEncryptedZstdChunkedManifest(&blob, outMetadata, uint64(blob.Len()), tarSplit, metadata, 3, cek); err != nil {
+		t.Fatalf("WriteEncryptedZstdChunkedManifest: %v", err)
+	}
+
+	blobBytes := blob.Bytes()
+
+	toc, err := ReadEncryptedZstdChunkedManifest(bytes.NewReader(blobBytes), int64(len(blobBytes)), cek)
+	if err != nil {
+		t.Fatalf("ReadEncryptedZstdChunkedManifest: %v", err)
+	}
+	if len(toc.Entries) != len(metadata) {
+		t.Fatalf("decrypted TOC has %d entries, want %d", len(toc.Entries), len(metadata))
+	}
+
+	if _, err := ReadEncryptedZstdChunkedManifest(bytes.NewReader(blobBytes), int64(len(blobBytes)), bytes.Repeat([]byte{0}, contentEncryptionKeySize)); err == nil {
+		t.Fatal("expected ReadEncryptedZstdChunkedManifest to fail with the wrong key")
+	}
+
+	reader, err := NewZstdChunkedReader(bytes.NewReader(blobBytes), int64(len(blobBytes)))
+	if err == nil {
+		t.Fatalf("NewZstdChunkedReader should not be able to parse an encrypted manifest without decrypting it first, got reader %v", reader)
+	}
+
+	encReader := &ZstdChunkedReader{
+		ra:          bytes.NewReader(blobBytes),
+		size:        int64(len(blobBytes)),
+		toc:         toc,
+		byName:      map[string]FileMetadata{},
+		coalesceGap: defaultCoalesceGap,
+	}
+	for _, e := range toc.Entries {
+		if e.Type == TypeReg || e.Type == TypeChunk {
+			encReader.byName[e.Name] = e
+		}
+	}
+
+	if _, err := encReader.OpenFile("fileA"); err == nil {
+		t.Fatal("expected OpenFile to fail before SetContentEncryptionKey is called")
+	}
+
+	encReader.SetContentEncryptionKey(cek)
+	rc, err := encReader.OpenFile("fileA")
+	if err != nil {
+		t.Fatalf("OpenFile(fileA): %v", err)
+	}
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading fileA: %v", err)
+	}
+	if !bytes.Equal(got, fileA) {
+		t.Fatalf("fileA round-trip mismatch: got %d bytes, want %d bytes", len(got), len(fileA))
+	}
+}
@@ -0,0 +1,318 @@
+package internal
+
+// NOTE: This is used from github.com/containers/image by callers that
+// don't otherwise use containers/storage, so don't make this depend on any
+// larger software like the graph drivers.
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// TOCJSONDigestAnnotation is the annotation added to the manifest that contains the digest of
+	// the estargz TOC JSON, as produced by stargz-snapshotter.
+	TOCJSONDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+
+	// estargzFooterSize is the size in bytes of the gzip footer appended after the TOC entry:
+	// an empty gzip member whose FEXTRA field holds the TOC offset as 16 hex digits followed by
+	// estargzFooterMagic, with no subfield header. This is the 47-byte legacy eStargz footer;
+	// the 51-byte footer with an "SG" FEXTRA subfield is neither written nor parsed here.
+	estargzFooterSize = 47
+
+	// estargzFooterMagic is the fixed suffix of the FEXTRA payload in every estargz footer.
+	estargzFooterMagic = "STARGZ"
+
+	// estargzTOCEntryName is the name of the tar entry that stores the TOC JSON.
+	estargzTOCEntryName = "stargz.index.json"
+)
+
+// EstargzFooterData contains the data stored in the estargz footer, i.e. the gzip stream that
+// points at the offset of the TOC entry.
+type EstargzFooterData struct {
+	// TOCOffset is the offset of the gzip stream containing the TOC JSON tar entry.
+	TOCOffset uint64
+}
+
+// estargzTOCEntry is a single entry of the estargz TOC JSON, as consumed by stargz-snapshotter.
+// It mirrors the subset of github.com/containerd/stargz-snapshotter/estargz.TOCEntry fields
+// that round-trip with FileMetadata.
+type estargzTOCEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime3339 string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	DevMajor    int64             `json:"devMajor,omitempty"`
+	DevMinor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string]string `json:"xattrs,omitempty"`
+
+	Offset      int64  `json:"offset,omitempty"`
+	ChunkOffset int64  `json:"chunkOffset,omitempty"`
+	ChunkSize   int64  `json:"chunkSize,omitempty"`
+	ChunkDigest string `json:"chunkDigest,omitempty"`
+	Digest      string `json:"digest,omitempty"`
+}
+
+// estargzTOC is the top-level structure of stargz.index.json.
+type estargzTOC struct {
+	Version int               `json:"version"`
+	Entries []estargzTOCEntry `json:"entries"`
+}
+
+// WriteEstargzFooter writes to dest a gzip stream containing the stargz.index.json tar entry
+// for tocData, followed by the fixed-size estargz footer pointing back at it. offset is the
+// number of bytes already written to dest before this call (dest is a plain io.Writer, so it
+// cannot be queried for its own length); it becomes the TOCOffset recorded in the footer, and in
+// the returned EstargzFooterData for callers that also need to annotate it elsewhere.
+func WriteEstargzFooter(dest io.Writer, offset uint64, tocData []byte) (EstargzFooterData, error) {
+	footerData := EstargzFooterData{TOCOffset: offset}
+
+	gzipWriter := gzip.NewWriter(dest)
+	tarWriter := tar.NewWriter(gzipWriter)
+	hdr := &tar.Header{
+		Name:     estargzTOCEntryName,
+		Typeflag: tar.TypeReg,
+		Size:     int64(len(tocData)),
+		Mode:     0o644,
+	}
+	if err := tarWriter.WriteHeader(hdr); err != nil {
+		return footerData, err
+	}
+	if _, err := tarWriter.Write(tocData); err != nil {
+		return footerData, err
+	}
+	if err := tarWriter.Close(); err != nil {
+		return footerData, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return footerData, err
+	}
+
+	footer, err := estargzFooterBytes(footerData.TOCOffset)
+	if err != nil {
+		return footerData, err
+	}
+	if _, err := dest.Write(footer); err != nil {
+		return footerData, err
+	}
+	return footerData, nil
+}
+
+// ReadEstargzFooter parses the trailing estargz footer and returns the offset of the gzip stream
+// holding the TOC entry. footer must be exactly the bytes produced by WriteEstargzFooter (an
+// empty gzip member whose FEXTRA field carries the offset, see estargzFooterSize).
+func ReadEstargzFooter(footer []byte) (EstargzFooterData, error) {
+	var footerData EstargzFooterData
+
+	if len(footer) != estargzFooterSize {
+		return footerData, fmt.Errorf("invalid estargz footer size %d, expected %d", len(footer), estargzFooterSize)
+	}
+
+	gzr, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		return footerData, fmt.Errorf("parsing estargz footer as gzip: %w", err)
+	}
+	defer gzr.Close()
+	if _, err := io.Copy(io.Discard, gzr); err != nil {
+		return footerData, fmt.Errorf("reading estargz footer payload: %w", err)
+	}
+
+	extra := string(gzr.Header.Extra)
+	if !strings.HasSuffix(extra, estargzFooterMagic) {
+		return footerData, errors.New("invalid estargz footer magic")
+	}
+	hexOffset := strings.TrimSuffix(extra, estargzFooterMagic)
+	offset, err := strconv.ParseUint(hexOffset, 16, 64)
+	if err != nil {
+		return footerData, fmt.Errorf("parsing estargz footer TOC offset: %w", err)
+	}
+	footerData.TOCOffset = offset
+	return footerData, nil
+}
+
+// estargzFooterBytes builds the fixed-size gzip member that terminates an estargz blob: an empty
+// gzip stream whose FEXTRA header carries tocOffset as 16 hex digits followed by the estargzFooterMagic
+// suffix, with no subfield header (the legacy 47-byte eStargz footer layout). It self-validates the resulting
+// size against estargzFooterSize so a future change to the Go gzip implementation can't silently
+// produce an unparseable footer.
+func estargzFooterBytes(tocOffset uint64) ([]byte, error) {
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.NoCompression)
+	if err != nil {
+		return nil, err
+	}
+	gz.Extra = []byte(fmt.Sprintf("%016x%s", tocOffset, estargzFooterMagic))
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	footer := buf.Bytes()
+	if len(footer) != estargzFooterSize {
+		return nil, fmt.Errorf("internal error: estargz footer is %d bytes, expected %d", len(footer), estargzFooterSize)
+	}
+	return footer, nil
+}
+
+// estargzTOCToTOC converts an estargz TOC JSON document into the TOC/FileMetadata types used
+// internally, so that a zstd:chunked-aware reader can consume an eStargz-produced layer.
+func estargzTOCToTOC(e *estargzTOC) (*TOC, error) {
+	toc := &TOC{
+		Version: e.Version,
+		Entries: make([]FileMetadata, 0, len(e.Entries)),
+	}
+	for _, entry := range e.Entries {
+		fm := FileMetadata{
+			Type:        entry.Type,
+			Name:        entry.Name,
+			Linkname:    entry.LinkName,
+			Mode:        entry.Mode,
+			Size:        entry.Size,
+			UID:         entry.UID,
+			GID:         entry.GID,
+			Devmajor:    entry.DevMajor,
+			Devminor:    entry.DevMinor,
+			Xattrs:      entry.Xattrs,
+			Digest:      entry.Digest,
+			Offset:      entry.Offset,
+			ChunkOffset: entry.ChunkOffset,
+			ChunkSize:   entry.ChunkSize,
+			ChunkDigest: entry.ChunkDigest,
+		}
+		if entry.ModTime3339 != "" {
+			modTime, err := time.Parse(time.RFC3339Nano, entry.ModTime3339)
+			if err != nil {
+				return nil, fmt.Errorf("parsing estargz modtime %q for %q: %w", entry.ModTime3339, entry.Name, err)
+			}
+			fm.ModTime = &modTime
+		}
+		toc.Entries = append(toc.Entries, fm)
+	}
+	return toc, nil
+}
+
+// tocToEstargzTOC converts the internal TOC/FileMetadata representation into the estargz TOC
+// JSON schema consumed by stargz-snapshotter.
+func tocToEstargzTOC(toc *TOC) *estargzTOC {
+	e := &estargzTOC{
+		Version: toc.Version,
+		Entries: make([]estargzTOCEntry, 0, len(toc.Entries)),
+	}
+	for _, entry := range toc.Entries {
+		tocEntry := estargzTOCEntry{
+			Name:        entry.Name,
+			Type:        entry.Type,
+			Size:        entry.Size,
+			LinkName:    entry.Linkname,
+			Mode:        entry.Mode,
+			UID:         entry.UID,
+			GID:         entry.GID,
+			DevMajor:    entry.Devmajor,
+			DevMinor:    entry.Devminor,
+			Xattrs:      entry.Xattrs,
+			Offset:      entry.Offset,
+			ChunkOffset: entry.ChunkOffset,
+			ChunkSize:   entry.ChunkSize,
+			ChunkDigest: entry.ChunkDigest,
+			Digest:      entry.Digest,
+		}
+		if entry.ModTime != nil {
+			tocEntry.ModTime3339 = entry.ModTime.UTC().Format(time.RFC3339Nano)
+		}
+		e.Entries = append(e.Entries, tocEntry)
+	}
+	return e
+}
+
+// WriteEstargzManifest marshals metadata as an estargz TOC JSON document, appends it to dest as
+// a gzip member followed by the estargz footer, and records the digest of the TOC JSON in
+// outMetadata under TOCJSONDigestAnnotation. offset is the number of bytes already
+// written to dest before this call, forwarded to WriteEstargzFooter.
+func WriteEstargzManifest(dest io.Writer, outMetadata map[string]string, offset uint64, metadata []FileMetadata) error {
+	toc := tocToEstargzTOC(&TOC{Version: 1, Entries: metadata})
+
+	tocJSON, err := json.Marshal(toc)
+	if err != nil {
+		return err
+	}
+
+	digester := digest.Canonical.Digester()
+	if _, err := digester.Hash().Write(tocJSON); err != nil {
+		return err
+	}
+	outMetadata[TOCJSONDigestAnnotation] = digester.Digest().String()
+
+	_, err = WriteEstargzFooter(dest, offset, tocJSON)
+	return err
+}
+
+// ReadEstargzManifest reads and parses the estargz TOC JSON found at footerData.TOCOffset within
+// ra, returning it translated to the internal TOC representation. If tocDigest is non-empty (the
+// value recorded by WriteEstargzManifest under TOCJSONDigestAnnotation), the raw TOC JSON is
+// checked against it before being parsed, and a mismatch is a fatal error rather than accepted
+// silently.
+func ReadEstargzManifest(ra io.ReaderAt, size int64, footerData EstargzFooterData, tocDigest string) (*TOC, error) {
+	if int64(footerData.TOCOffset) >= size {
+		return nil, errors.New("estargz TOC offset out of range")
+	}
+	sr := io.NewSectionReader(ra, int64(footerData.TOCOffset), size-int64(footerData.TOCOffset)-estargzFooterSize)
+	gzReader, err := gzip.NewReader(sr)
+	if err != nil {
+		return nil, err
+	}
+	defer gzReader.Close()
+
+	tarReader := tar.NewReader(gzReader)
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("estargz TOC entry %q not found", estargzTOCEntryName)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name != estargzTOCEntryName {
+			continue
+		}
+		tocJSON, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, err
+		}
+		if tocDigest != "" {
+			if err := validateTOCJSONDigest(tocJSON, tocDigest); err != nil {
+				return nil, err
+			}
+		}
+		var toc estargzTOC
+		if err := json.Unmarshal(tocJSON, &toc); err != nil {
+			return nil, err
+		}
+		return estargzTOCToTOC(&toc)
+	}
+}
+
+// validateTOCJSONDigest verifies that tocJSON hashes to expected, mirroring
+// validateManifestChecksum's role for the zstd:chunked manifest.
+func validateTOCJSONDigest(tocJSON []byte, expected string) error {
+	digester := digest.Canonical.Digester()
+	if _, err := digester.Hash().Write(tocJSON); err != nil {
+		return err
+	}
+	if digester.Digest().String() != expected {
+		return fmt.Errorf("estargz TOC digest mismatch: got %s, expected %s", digester.Digest(), expected)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEstargzFooterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := buf.Write(make([]byte, 114)); err != nil { // pad so TOCOffset isn't 0
+		t.Fatal(err)
+	}
+
+	footerData, err := WriteEstargzFooter(&buf, uint64(buf.Len()), []byte(`{"version":1,"entries":[]}`))
+	if err != nil {
+		t.Fatalf("WriteEstargzFooter: %v", err)
+	}
+	if footerData.TOCOffset != 114 {
+		t.Fatalf("unexpected TOCOffset from write: got %d, want 114", footerData.TOCOffset)
+	}
+
+	all := buf.Bytes()
+	footer := all[len(all)-estargzFooterSize:]
+
+	got, err := ReadEstargzFooter(footer)
+	if err != nil {
+		t.Fatalf("ReadEstargzFooter: %v", err)
+	}
+	if got.TOCOffset != footerData.TOCOffset {
+		t.Fatalf("footer round-trip mismatch: wrote %d, read back %d", footerData.TOCOffset, got.TOCOffset)
+	}
+}
+
+func TestEstargzManifestRoundTrip(t *testing.T) {
+	metadata := []FileMetadata{
+		{Type: TypeDir, Name: "a"},
+		{Type: TypeReg, Name: "a/b", Size: 3, Digest: "sha256:deadbeef"},
+	}
+
+	var buf bytes.Buffer
+	// Pad the destination so the TOC isn't at offset 0, exercising the same path a real
+	// caller would hit when the TOC follows file data in the blob.
+	if _, err := buf.Write(make([]byte, 37)); err != nil {
+		t.Fatal(err)
+	}
+	tocOffset := int64(buf.Len())
+
+	outMetadata := map[string]string{}
+	if err := WriteEstargzManifest(&buf, outMetadata, uint64(tocOffset), metadata); err != nil {
+		t.Fatalf("WriteEstargzManifest: %v", err)
+	}
+	if outMetadata[TOCJSONDigestAnnotation] == "" {
+		t.Fatal("WriteEstargzManifest did not record a TOC digest annotation")
+	}
+
+	toc, err := ReadEstargzManifest(bytes.NewReader(buf.Bytes()), int64(buf.Len()), EstargzFooterData{TOCOffset: uint64(tocOffset)}, outMetadata[TOCJSONDigestAnnotation])
+	if err != nil {
+		t.Fatalf("ReadEstargzManifest: %v", err)
+	}
+	if len(toc.Entries) != len(metadata) {
+		t.Fatalf("got %d entries, want %d", len(toc.Entries), len(metadata))
+	}
+	if toc.Entries[1].Name != "a/b" || toc.Entries[1].Size != 3 {
+		t.Fatalf("unexpected entry round-trip: %+v", toc.Entries[1])
+	}
+
+	if _, err := ReadEstargzManifest(bytes.NewReader(buf.Bytes()), int64(buf.Len()), EstargzFooterData{TOCOffset: uint64(tocOffset)}, "sha256:"+strings.Repeat("0", 64)); err == nil {
+		t.Fatal("expected ReadEstargzManifest to fail when tocDigest doesn't match the TOC JSON")
+	}
+}
+
+// TestEstargzModTimeRoundTrip checks that FileMetadata.ModTime survives the translation to the
+// estargz TOC JSON schema and back.
+func TestEstargzModTimeRoundTrip(t *testing.T) {
+	modTime := time.Date(2024, 3, 5, 12, 30, 0, 0, time.UTC)
+	metadata := []FileMetadata{
+		{Type: TypeReg, Name: "a", Size: 1, ModTime: &modTime},
+	}
+
+	e := tocToEstargzTOC(&TOC{Version: 1, Entries: metadata})
+	if e.Entries[0].ModTime3339 == "" {
+		t.Fatal("tocToEstargzTOC did not populate ModTime3339")
+	}
+
+	toc, err := estargzTOCToTOC(e)
+	if err != nil {
+		t.Fatalf("estargzTOCToTOC: %v", err)
+	}
+	if toc.Entries[0].ModTime == nil || !toc.Entries[0].ModTime.Equal(modTime) {
+		t.Fatalf("ModTime round-trip mismatch: got %v, want %v", toc.Entries[0].ModTime, modTime)
+	}
+}
@@ -0,0 +1,124 @@
+package internal
+
+// NOTE: This is used from github.com/containers/image by callers that
+// don't otherwise use containers/storage, so don't make this depend on any
+// larger software like the graph drivers.
+
+import (
+	"bufio"
+	"io"
+	"math/bits"
+)
+
+// gearTable is the fixed pseudo-random table used by the FastCDC rolling gear hash. Values are
+// arbitrary but must stay fixed: reusing the same table between builds is what lets cut points
+// reappear in the same place across layers of the same file.
+var gearTable = func() [256]uint64 {
+	var t [256]uint64
+	// A simple fixed-point PRNG (splitmix64) seeded with a constant, used only to fill the
+	// table deterministically without pulling in a real PRNG dependency.
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range t {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		z = z ^ (z >> 31)
+		t[i] = z
+	}
+	return t
+}()
+
+// fastCDCParams holds the normalized bounds and bitmasks for one chunking pass, derived from the
+// caller's min/avg/max sizes as described in the FastCDC paper.
+type fastCDCParams struct {
+	min, avg, max int
+	maskS, maskL  uint64
+}
+
+func newFastCDCParams(min, avg, max int) fastCDCParams {
+	if min <= 0 {
+		min = defaultChunkMinSize
+	}
+	if avg <= 0 {
+		avg = defaultChunkAvgSize
+	}
+	if max <= 0 {
+		max = defaultChunkMaxSize
+	}
+	// maskS/maskL bias the boundary probability below/above the average size: maskS requires
+	// more zero bits than avg's bit length, making a cut less likely below avg, and maskL
+	// requires fewer, making a cut more likely above it.
+	avgBits := bits.Len(uint(avg))
+	maskS := uint64(1)<<(avgBits+1) - 1
+	maskL := uint64(1)<<(avgBits-1) - 1
+	return fastCDCParams{min: min, avg: avg, max: max, maskS: maskS, maskL: maskL}
+}
+
+// chunkFastCDC reads size bytes from r and splits them into content-defined chunks using FastCDC:
+// a 64-bit rolling gear hash is maintained over a sliding window, and a boundary is declared when
+// hash&maskS == 0 for chunks still below avg, or hash&maskL == 0 above it, so that small edits to
+// the input only ever invalidate the chunks touching the edit.
+func chunkFastCDC(r io.Reader, size int64, min, avg, max int) ([][]byte, error) {
+	if size <= int64(min) {
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return [][]byte{buf}, nil
+	}
+
+	params := newFastCDCParams(min, avg, max)
+
+	br := bufio.NewReaderSize(r, 256*1024)
+	var chunks [][]byte
+	var current []byte
+	var hash uint64
+
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		current = append(current, b)
+		hash = (hash << 1) + gearTable[b]
+
+		n := len(current)
+		if n < params.min {
+			continue
+		}
+		if n >= params.max {
+			chunks = append(chunks, current)
+			current = nil
+			hash = 0
+			continue
+		}
+
+		var boundary bool
+		if n < params.avg {
+			boundary = hash&params.maskS == 0
+		} else {
+			boundary = hash&params.maskL == 0
+		}
+		if boundary {
+			chunks = append(chunks, current)
+			current = nil
+			hash = 0
+		}
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, current)
+	}
+
+	var total int64
+	for _, c := range chunks {
+		total += int64(len(c))
+	}
+	if total != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return chunks, nil
+}
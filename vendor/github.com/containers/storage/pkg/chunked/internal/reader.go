@@ -0,0 +1,302 @@
+package internal
+
+// NOTE: This is used from github.com/containers/image by callers that
+// don't otherwise use containers/storage, so don't make this depend on any
+// larger software like the graph drivers.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// defaultCoalesceGap is the default maximum gap, in bytes, between two chunks for ReadChunks to
+// merge them into a single range read.
+const defaultCoalesceGap = 4 * 1024
+
+// ZstdChunkedReader provides random-access extraction from a zstd:chunked blob, without
+// depending on the graph-driver-heavy pkg/chunked package.
+type ZstdChunkedReader struct {
+	ra   io.ReaderAt
+	size int64
+
+	footer      ZstdChunkedFooterData
+	toc         *TOC
+	byName      map[string]FileMetadata
+	coalesceGap int64
+
+	// cek is the content encryption key used to open chunks sealed with
+	// WriterOptions.ContentEncryptionKey. It is nil unless SetContentEncryptionKey was called.
+	cek []byte
+}
+
+// NewZstdChunkedReader reads the footer and manifest of the zstd:chunked blob exposed through ra
+// (of the given size) and returns a reader that can be used for random-access extraction of
+// individual files. The manifest checksum is only recorded in the ManifestChecksumKey
+// annotation, not in the blob's footer, so no checksum is validated here.
+func NewZstdChunkedReader(ra io.ReaderAt, size int64) (*ZstdChunkedReader, error) {
+	if size < FooterSizeSupported {
+		return nil, errors.New("blob too small to contain a zstd:chunked footer")
+	}
+
+	footerBytes := make([]byte, FooterSizeSupported)
+	if _, err := ra.ReadAt(footerBytes, size-FooterSizeSupported); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading zstd:chunked footer: %w", err)
+	}
+
+	footer, err := ReadFooterDataFromBlob(footerBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	compressed := make([]byte, footer.LengthCompressed)
+	if _, err := ra.ReadAt(compressed, int64(footer.Offset)); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading zstd:chunked manifest: %w", err)
+	}
+
+	if footer.ChecksumAnnotation != "" {
+		if err := validateManifestChecksum(compressed, footer.ChecksumAnnotation); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest, err := decompressFrame(compressed, int64(footer.LengthUncompressed))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing zstd:chunked manifest: %w", err)
+	}
+
+	var toc TOC
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	if err := json.Unmarshal(manifest, &toc); err != nil {
+		return nil, fmt.Errorf("parsing zstd:chunked TOC: %w", err)
+	}
+
+	byName := make(map[string]FileMetadata, len(toc.Entries))
+	for _, e := range toc.Entries {
+		if e.Type == TypeReg || e.Type == TypeChunk {
+			byName[e.Name] = e
+		}
+	}
+
+	return &ZstdChunkedReader{
+		ra:          ra,
+		size:        size,
+		footer:      footer,
+		toc:         &toc,
+		byName:      byName,
+		coalesceGap: defaultCoalesceGap,
+	}, nil
+}
+
+// TOC returns the parsed table of contents for the blob.
+func (r *ZstdChunkedReader) TOC() *TOC {
+	return r.toc
+}
+
+// SetCoalesceGap overrides the default gap threshold used by ReadChunks to merge adjacent reads.
+func (r *ZstdChunkedReader) SetCoalesceGap(gap int64) {
+	r.coalesceGap = gap
+}
+
+// SetContentEncryptionKey enables decryption of chunks sealed with a matching
+// WriterOptions.ContentEncryptionKey: ReadChunks will open each chunk with cek, using its
+// recorded EncNonce/EncTag, before zstd-decompressing it.
+func (r *ZstdChunkedReader) SetContentEncryptionKey(cek []byte) {
+	r.cek = cek
+}
+
+// OpenFile returns a reader for the decompressed contents of the named regular file.
+func (r *ZstdChunkedReader) OpenFile(name string) (io.ReadCloser, error) {
+	entry, found := r.byName[name]
+	if !found {
+		return nil, fmt.Errorf("file %q not found in TOC", name)
+	}
+
+	chunks := r.chunksForFile(name, entry)
+	data, err := r.ReadChunks(chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, d := range data {
+		buf.Write(d)
+	}
+	return io.NopCloser(&buf), nil
+}
+
+// chunksForFile returns all TOC entries (single entry for a plain TypeReg file, or all
+// TypeChunk entries sharing the same name, in offset order) that make up name's content.
+func (r *ZstdChunkedReader) chunksForFile(name string, first FileMetadata) []FileMetadata {
+	if first.Type == TypeReg {
+		return []FileMetadata{first}
+	}
+
+	var chunks []FileMetadata
+	for _, e := range r.toc.Entries {
+		if e.Name == name && e.Type == TypeChunk {
+			chunks = append(chunks, e)
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].ChunkOffset < chunks[j].ChunkOffset })
+	return chunks
+}
+
+// byteRange is a [start, end) range of a file's compressed representation within the blob.
+type byteRange struct {
+	start, end int64
+	entries    []FileMetadata
+}
+
+// ReadChunks reads and decompresses the given entries, issuing coalesced range reads for entries
+// whose Offset/EndOffset are within r.coalesceGap of each other, and returns one decompressed
+// buffer per input entry, in the same order as entries.
+func (r *ZstdChunkedReader) ReadChunks(entries []FileMetadata) ([][]byte, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	for _, e := range entries {
+		if e.ChunkType == ChunkTypeDedup {
+			return nil, fmt.Errorf("chunk %q was deduplicated against another layer and is not present in this blob; use a Differ with a ChunkStore to resolve it", e.Name)
+		}
+	}
+
+	ranges := r.coalesceRanges(entries)
+
+	decompressed := make(map[*FileMetadata][]byte, len(entries))
+	for _, rg := range ranges {
+		buf := make([]byte, rg.end-rg.start)
+		if _, err := r.ra.ReadAt(buf, rg.start); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("reading chunk range [%d,%d): %w", rg.start, rg.end, err)
+		}
+
+		for i := range rg.entries {
+			e := &rg.entries[i]
+			if e.ChunkType == ChunkTypeZeros {
+				decompressed[e] = make([]byte, e.ChunkSize)
+				continue
+			}
+			start := r.entryOffset(*e) - rg.start
+			length := r.entryEndOffset(*e) - r.entryOffset(*e)
+			frame := buf[start : start+length]
+
+			if len(e.EncTag) > 0 {
+				if r.cek == nil {
+					return nil, ErrMissingContentEncryptionKey
+				}
+				opened, err := openChunk(r.cek, e.EncNonce, e.EncTag, frame)
+				if err != nil {
+					return nil, fmt.Errorf("decrypting chunk %q: %w", e.Name, err)
+				}
+				frame = opened
+			}
+
+			data, err := decompressFrame(frame, e.ChunkSize)
+			if err != nil {
+				return nil, fmt.Errorf("decompressing chunk %q: %w", e.Name, err)
+			}
+			decompressed[e] = data
+		}
+	}
+
+	result := make([][]byte, len(entries))
+	for i := range entries {
+		for rgIdx := range ranges {
+			for j := range ranges[rgIdx].entries {
+				if sameEntry(ranges[rgIdx].entries[j], entries[i]) {
+					result[i] = decompressed[&ranges[rgIdx].entries[j]]
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+func sameEntry(a, b FileMetadata) bool {
+	return a.Name == b.Name && a.ChunkOffset == b.ChunkOffset
+}
+
+func (r *ZstdChunkedReader) entryOffset(e FileMetadata) int64 {
+	return entryCompressedOffset(e)
+}
+
+func (r *ZstdChunkedReader) entryEndOffset(e FileMetadata) int64 {
+	return entryCompressedEndOffset(e)
+}
+
+// entryCompressedOffset returns e's starting position within the blob's compressed chunk stream.
+// writer.go's serialize only ever populates ChunkOffset (not Offset) for TypeChunk entries, so
+// the two types need different fields here.
+func entryCompressedOffset(e FileMetadata) int64 {
+	if e.Type == TypeChunk {
+		return e.ChunkOffset
+	}
+	return e.Offset
+}
+
+// entryCompressedEndOffset returns the byte offset one past the end of e's compressed data within
+// the blob.
+func entryCompressedEndOffset(e FileMetadata) int64 {
+	if e.EndOffset != 0 {
+		return e.EndOffset
+	}
+	return entryCompressedOffset(e) + e.ChunkSize
+}
+
+// coalesceRanges groups entries (sorted by offset) into byteRanges, merging consecutive entries
+// whose gap is within r.coalesceGap into a single range read.
+func (r *ZstdChunkedReader) coalesceRanges(entries []FileMetadata) []byteRange {
+	sorted := make([]FileMetadata, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool { return r.entryOffset(sorted[i]) < r.entryOffset(sorted[j]) })
+
+	var ranges []byteRange
+	for _, e := range sorted {
+		start := r.entryOffset(e)
+		end := r.entryEndOffset(e)
+		if e.ChunkType == ChunkTypeZeros {
+			ranges = append(ranges, byteRange{start: start, end: start, entries: []FileMetadata{e}})
+			continue
+		}
+		if n := len(ranges); n > 0 && start-ranges[n-1].end <= r.coalesceGap {
+			ranges[n-1].end = end
+			ranges[n-1].entries = append(ranges[n-1].entries, e)
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, end: end, entries: []FileMetadata{e}})
+	}
+	return ranges
+}
+
+func decompressFrame(compressed []byte, uncompressedSize int64) ([]byte, error) {
+	decoder, err := zstd.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	out := make([]byte, 0, uncompressedSize)
+	buf := bytes.NewBuffer(out)
+	if _, err := io.Copy(buf, decoder); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func validateManifestChecksum(compressed []byte, expected string) error {
+	digester := digest.Canonical.Digester()
+	if _, err := digester.Hash().Write(compressed); err != nil {
+		return err
+	}
+	if digester.Digest().String() != expected {
+		return fmt.Errorf("manifest checksum mismatch: got %s, expected %s", digester.Digest(), expected)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// buildTar returns a tar stream containing the given regular files.
+func buildTar(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"fileA", "fileB"} {
+		data, ok := files[name]
+		if !ok {
+			continue
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Size: int64(len(data)), Mode: 0o644}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestZstdChunkedWriterReaderRoundTrip(t *testing.T) {
+	fileA := bytes.Repeat([]byte("A"), 200*1024)
+	fileB := bytes.Repeat([]byte("B"), 200*1024)
+	tarStream := buildTar(t, map[string][]byte{"fileA": fileA, "fileB": fileB})
+
+	var blob bytes.Buffer
+	// A small max chunk size forces both files to be split into several chunks regardless of
+	// where the content-defined hash happens to cut, so the test exercises multi-chunk,
+	// multi-file random access rather than relying on the hash finding a boundary.
+	w := NewZstdChunkedWriter(&blob, WriterOptions{ChunkMinSize: 16 * 1024, ChunkAvgSize: 32 * 1024, ChunkMaxSize: 48 * 1024})
+	if _, err := w.Write(tarStream); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	metadata := w.Metadata()
+	var chunkCount int
+	for _, e := range metadata {
+		if e.Type == TypeChunk {
+			chunkCount++
+		}
+	}
+	if chunkCount < 2 {
+		t.Fatalf("expected at least 2 chunk entries across both files, got %d", chunkCount)
+	}
+
+	outMetadata := map[string]string{}
+	tarSplit := &TarSplitData{Data: []byte{}, Digest: digest.Digest("sha256:" + strings.Repeat("0", 64))}
+	if err := WriteZstdChunkedManifest(&blob, outMetadata, uint64(blob.Len()), tarSplit, metadata, 3); err != nil {
+		t.Fatalf("WriteZstdChunkedManifest: %v", err)
+	}
+
+	blobBytes := blob.Bytes()
+	reader, err := NewZstdChunkedReader(bytes.NewReader(blobBytes), int64(len(blobBytes)))
+	if err != nil {
+		t.Fatalf("NewZstdChunkedReader: %v", err)
+	}
+
+	rc, err := reader.OpenFile("fileB")
+	if err != nil {
+		t.Fatalf("OpenFile(fileB): %v", err)
+	}
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading fileB: %v", err)
+	}
+	if !bytes.Equal(got, fileB) {
+		t.Fatalf("fileB round-trip mismatch: got %d bytes starting with %q, want %d bytes starting with %q",
+			len(got), got[:min(4, len(got))], len(fileB), fileB[:4])
+	}
+
+	rc, err = reader.OpenFile("fileA")
+	if err != nil {
+		t.Fatalf("OpenFile(fileA): %v", err)
+	}
+	got, err = io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading fileA: %v", err)
+	}
+	if !bytes.Equal(got, fileA) {
+		t.Fatalf("fileA round-trip mismatch: got %d bytes, want %d bytes", len(got), len(fileA))
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
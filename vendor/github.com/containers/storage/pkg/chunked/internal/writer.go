@@ -0,0 +1,399 @@
+package internal
+
+// NOTE: This is used from github.com/containers/image by callers that
+// don't otherwise use containers/storage, so don't make this depend on any
+// larger software like the graph drivers.
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	defaultChunkMinSize = 64 * 1024
+	defaultChunkAvgSize = 256 * 1024
+	defaultChunkMaxSize = 1024 * 1024
+)
+
+// WriterOptions controls how NewZstdChunkedWriter splits and compresses the tar stream it is
+// given.
+type WriterOptions struct {
+	// CompressionLevel is the zstd level used for each chunk, passed to ZstdWriterWithLevel as
+	// is. Zero maps to the zstd package's fastest encoder level.
+	CompressionLevel int
+
+	// ChunkMinSize, ChunkAvgSize and ChunkMaxSize bound the content-defined chunk boundaries.
+	// Zero values fall back to 64KiB/256KiB/1MiB.
+	ChunkMinSize int
+	ChunkAvgSize int
+	ChunkMaxSize int
+
+	// WorkerCount bounds the number of goroutines used to compress chunks concurrently. Zero
+	// uses runtime.GOMAXPROCS(0).
+	WorkerCount int
+
+	// ChunkIndex, if set, is consulted for every content-defined chunk before it is
+	// compressed: a chunk whose digest is already present in the index is recorded in the TOC
+	// by digest and size alone, without writing its compressed bytes to dest, so that the
+	// pull-side differ can instead fetch it from the layer that originally introduced it.
+	ChunkIndex *ChunkIndex
+
+	// ContentEncryptionKey, if set, causes every compressed chunk to be individually sealed
+	// with AES-256-GCM (see sealChunk) before it is written to dest. The per-chunk nonce and
+	// tag are recorded in FileMetadata.EncNonce/EncTag so a reader holding the same key can
+	// open one chunk at a time without downloading the whole blob. The manifest itself is not
+	// sealed by this option; callers that also want an encrypted manifest must write it with
+	// WriteEncryptedZstdChunkedManifest using the same key.
+	ContentEncryptionKey []byte
+}
+
+func (o WriterOptions) withDefaults() WriterOptions {
+	if o.ChunkMinSize == 0 {
+		o.ChunkMinSize = defaultChunkMinSize
+	}
+	if o.ChunkAvgSize == 0 {
+		o.ChunkAvgSize = defaultChunkAvgSize
+	}
+	if o.ChunkMaxSize == 0 {
+		o.ChunkMaxSize = defaultChunkMaxSize
+	}
+	if o.WorkerCount <= 0 {
+		o.WorkerCount = runtime.GOMAXPROCS(0)
+	}
+	return o
+}
+
+// chunkJob is a single content-defined chunk of a regular file's data, submitted to the worker
+// pool for independent zstd compression.
+type chunkJob struct {
+	seq  uint64
+	data []byte
+}
+
+// chunkResult is the compressed output of a chunkJob, tagged with its original sequence number
+// so the writer goroutine can serialize results back into submission order. err is set instead
+// of the other fields if compressing this chunk failed.
+type chunkResult struct {
+	seq        uint64
+	compressed []byte
+	digest     digest.Digest
+	isZeros    bool
+	err        error
+}
+
+// ZstdChunkedWriter consumes a tar stream and emits a zstd:chunked blob, compressing
+// content-defined chunks of regular files in parallel across a worker pool.
+//
+// Callers must Write() the raw tar stream to it and Close() it when done; the resulting
+// []FileMetadata is then available from Metadata for WriteZstdChunkedManifest. The writer does
+// not produce tar-split data.
+type ZstdChunkedWriter struct {
+	dest    io.Writer
+	opts    WriterOptions
+	tarPipe *io.PipeWriter
+
+	metadata []FileMetadata
+	errCh    chan error
+	doneCh   chan struct{}
+
+	// dedupedIndices marks positions in metadata whose ChunkDigest was already present in
+	// opts.ChunkIndex: no job was submitted for them and serialize must not consume a result
+	// for them.
+	dedupedIndices map[int]struct{}
+
+	// pendingIndexAdds accumulates the (digest, size) pairs for every chunk written by this
+	// build that should become visible to opts.ChunkIndex.Lookup. They are only merged into
+	// the index once run() has completed successfully, so that a chunk can never be deduped
+	// against another chunk emitted earlier in this same, still in-progress build.
+	pendingIndexAdds []chunkIndexAdd
+}
+
+// chunkIndexAdd is one (digest, size) pair queued for ChunkIndex until the build it came from
+// finishes successfully.
+type chunkIndexAdd struct {
+	digest string
+	size   int64
+}
+
+// NewZstdChunkedWriter returns a ZstdChunkedWriter that writes a zstd:chunked blob to dest from
+// the raw tar stream written to the returned writer. Nothing is written to dest until the whole
+// tar stream has been read; the compressed chunks are then written in order before Close returns.
+//
+// The tar stream is parsed and chunked on a background goroutine, mirroring the historical
+// chunkedZstdWriter pipe/error-channel pattern: callers write the tar stream to the returned
+// io.WriteCloser, and must check the error returned by Close to learn about any failure that
+// happened on the background goroutine.
+func NewZstdChunkedWriter(dest io.Writer, opts WriterOptions) *ZstdChunkedWriter {
+	opts = opts.withDefaults()
+
+	pipeReader, pipeWriter := io.Pipe()
+	w := &ZstdChunkedWriter{
+		dest:    dest,
+		opts:    opts,
+		tarPipe: pipeWriter,
+		errCh:   make(chan error, 1),
+		doneCh:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.doneCh)
+		err := w.run(pipeReader)
+		pipeReader.CloseWithError(err)
+		w.errCh <- err
+	}()
+
+	return w
+}
+
+// Write implements io.Writer over the raw tar stream being chunked.
+func (w *ZstdChunkedWriter) Write(p []byte) (int, error) {
+	return w.tarPipe.Write(p)
+}
+
+// Close finishes writing the tar stream and waits for the background goroutine to finish
+// emitting chunks. It returns the first error encountered, if any.
+func (w *ZstdChunkedWriter) Close() error {
+	if err := w.tarPipe.Close(); err != nil {
+		return err
+	}
+	<-w.doneCh
+	return <-w.errCh
+}
+
+// Metadata returns the accumulated per-file metadata, including chunk information. It must only
+// be called after Close has returned a nil error.
+func (w *ZstdChunkedWriter) Metadata() []FileMetadata {
+	return w.metadata
+}
+
+func (w *ZstdChunkedWriter) run(tarStream io.Reader) error {
+	jobs := make(chan chunkJob)
+	results := make(chan chunkResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < w.opts.WorkerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.compressWorker(jobs, results)
+		}()
+	}
+
+	collectDone := make(chan error, 1)
+	pending := map[uint64]chunkResult{}
+	var collectErr error
+	var mu sync.Mutex
+
+	go func() {
+		for res := range results {
+			mu.Lock()
+			pending[res.seq] = res
+			if res.err != nil && collectErr == nil {
+				collectErr = res.err
+			}
+			mu.Unlock()
+		}
+		collectDone <- nil
+	}()
+
+	splitErr := w.splitTar(tarStream, jobs)
+	close(jobs)
+	wg.Wait()
+	close(results)
+	<-collectDone
+
+	if splitErr != nil {
+		return splitErr
+	}
+	if collectErr != nil {
+		return collectErr
+	}
+
+	if err := w.serialize(pending); err != nil {
+		return err
+	}
+
+	// Only now that the whole build has succeeded do this build's chunks become eligible for
+	// future builds to dedup against: see pendingIndexAdds' doc comment.
+	if w.opts.ChunkIndex != nil {
+		for _, a := range w.pendingIndexAdds {
+			w.opts.ChunkIndex.add(a.digest, a.size)
+		}
+	}
+	return nil
+}
+
+// splitTar reads entries from the tar stream, submits each regular file's content as one or more
+// content-defined chunks to jobs, and records the resulting FileMetadata (without chunk offsets,
+// which are filled in by serialize once compression order is known).
+func (w *ZstdChunkedWriter) splitTar(r io.Reader, jobs chan<- chunkJob) error {
+	tr := tar.NewReader(r)
+	var seq uint64
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		typ, err := GetType(hdr.Typeflag)
+		if err != nil {
+			return err
+		}
+
+		entry := FileMetadata{
+			Type:     typ,
+			Name:     hdr.Name,
+			Linkname: hdr.Linkname,
+			Mode:     hdr.Mode,
+			Size:     hdr.Size,
+			UID:      hdr.Uid,
+			GID:      hdr.Gid,
+			Devmajor: hdr.Devmajor,
+			Devminor: hdr.Devminor,
+		}
+
+		if typ != TypeReg || hdr.Size == 0 {
+			w.metadata = append(w.metadata, entry)
+			continue
+		}
+
+		chunks, err := chunkFastCDC(tr, hdr.Size, w.opts.ChunkMinSize, w.opts.ChunkAvgSize, w.opts.ChunkMaxSize)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			chunkEntry := entry
+			chunkEntry.Type = TypeChunk
+			chunkEntry.ChunkSize = int64(len(chunk))
+			chunkEntry.Size = hdr.Size
+
+			if w.opts.ChunkIndex != nil {
+				if dig, ok := w.opts.ChunkIndex.Lookup(chunk); ok {
+					chunkEntry.ChunkDigest = dig
+					chunkEntry.ChunkType = ChunkTypeDedup
+					w.metadata = append(w.metadata, chunkEntry)
+					if w.dedupedIndices == nil {
+						w.dedupedIndices = map[int]struct{}{}
+					}
+					w.dedupedIndices[len(w.metadata)-1] = struct{}{}
+					continue
+				}
+			}
+
+			jobs <- chunkJob{seq: seq, data: chunk}
+			w.metadata = append(w.metadata, chunkEntry)
+			if w.opts.ChunkIndex != nil {
+				w.pendingIndexAdds = append(w.pendingIndexAdds, chunkIndexAdd{digest: chunkDigestHex(chunk), size: chunkEntry.ChunkSize})
+			}
+			seq++
+		}
+	}
+}
+
+func (w *ZstdChunkedWriter) compressWorker(jobs <-chan chunkJob, results chan<- chunkResult) {
+	for job := range jobs {
+		if isAllZeros(job.data) {
+			sum := sha256.Sum256(job.data)
+			results <- chunkResult{
+				seq:     job.seq,
+				isZeros: true,
+				digest:  digest.NewDigestFromEncoded(digest.SHA256, hex.EncodeToString(sum[:])),
+			}
+			continue
+		}
+
+		var buf bytes.Buffer
+		zw, err := ZstdWriterWithLevel(&buf, w.opts.CompressionLevel)
+		if err != nil {
+			results <- chunkResult{seq: job.seq, err: fmt.Errorf("creating zstd encoder for chunk %d: %w", job.seq, err)}
+			continue
+		}
+		if _, err := zw.Write(job.data); err != nil {
+			zw.Close()
+			results <- chunkResult{seq: job.seq, err: fmt.Errorf("compressing chunk %d: %w", job.seq, err)}
+			continue
+		}
+		if err := zw.Close(); err != nil {
+			results <- chunkResult{seq: job.seq, err: fmt.Errorf("closing zstd encoder for chunk %d: %w", job.seq, err)}
+			continue
+		}
+
+		sum := sha256.Sum256(job.data)
+		results <- chunkResult{
+			seq:        job.seq,
+			compressed: buf.Bytes(),
+			digest:     digest.NewDigestFromEncoded(digest.SHA256, hex.EncodeToString(sum[:])),
+		}
+	}
+}
+
+// serialize writes each chunk's compressed bytes to dest in submission order, filling in the
+// ChunkOffset/ChunkDigest/EndOffset/ChunkType fields of the corresponding FileMetadata entries.
+func (w *ZstdChunkedWriter) serialize(results map[uint64]chunkResult) error {
+	var offset int64
+	var seq uint64
+
+	for i := range w.metadata {
+		if w.metadata[i].Type != TypeChunk {
+			continue
+		}
+		if _, deduped := w.dedupedIndices[i]; deduped {
+			continue
+		}
+		res, ok := results[seq]
+		seq++
+		if !ok {
+			return fmt.Errorf("missing compressed chunk %d", seq-1)
+		}
+		if res.err != nil {
+			return res.err
+		}
+
+		w.metadata[i].ChunkOffset = offset
+		w.metadata[i].ChunkDigest = res.digest.String()
+
+		if res.isZeros {
+			w.metadata[i].ChunkType = ChunkTypeZeros
+			continue
+		}
+
+		out := res.compressed
+		if w.opts.ContentEncryptionKey != nil {
+			sealed, nonce, tag, err := sealChunk(w.opts.ContentEncryptionKey, offset, res.compressed)
+			if err != nil {
+				return fmt.Errorf("sealing chunk %d: %w", seq-1, err)
+			}
+			w.metadata[i].EncNonce = nonce
+			w.metadata[i].EncTag = tag
+			out = sealed
+		}
+
+		if _, err := w.dest.Write(out); err != nil {
+			return err
+		}
+		offset += int64(len(out))
+		w.metadata[i].EndOffset = offset
+	}
+	return nil
+}
+
+func isAllZeros(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
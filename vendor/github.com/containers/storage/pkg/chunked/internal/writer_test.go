@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestZstdChunkedWriterSerializePropagatesWorkerErrors checks that a worker-side compression
+// failure reaches serialize() (and hence Close()) as an error instead of silently producing a
+// corrupt, empty chunk entry in the TOC.
+func TestZstdChunkedWriterSerializePropagatesWorkerErrors(t *testing.T) {
+	var blob bytes.Buffer
+	w := &ZstdChunkedWriter{
+		dest: &blob,
+		opts: WriterOptions{}.withDefaults(),
+		metadata: []FileMetadata{
+			{Type: TypeChunk, Name: "f", ChunkSize: 4},
+		},
+	}
+
+	wantErr := errors.New("boom")
+	err := w.serialize(map[uint64]chunkResult{0: {seq: 0, err: wantErr}})
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("serialize() = %v, want an error wrapping %v", err, wantErr)
+	}
+}
+
+// TestZstdChunkedWriterDoesNotSelfDedupWithinOneBuild checks that two files with identical
+// content in the same tar stream don't dedup against each other via ChunkIndex: the resulting
+// blob must be extractable on its own, without a ChunkStore, since nothing outside this build
+// ever held the "earlier" chunk's bytes.
+func TestZstdChunkedWriterDoesNotSelfDedupWithinOneBuild(t *testing.T) {
+	content := bytes.Repeat([]byte("Z"), 8*1024)
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for _, name := range []string{"fileA", "fileB"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Size: int64(len(content)), Mode: 0o644}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var blob bytes.Buffer
+	index := NewChunkIndex()
+	w := NewZstdChunkedWriter(&blob, WriterOptions{ChunkIndex: index})
+	if _, err := w.Write(tarBuf.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	for _, e := range w.Metadata() {
+		if e.Type == TypeChunk && e.ChunkType == ChunkTypeDedup {
+			t.Fatalf("entry %q deduped against a chunk from the same, still in-progress build", e.Name)
+		}
+	}
+
+	// Now that the build has finished, its chunks must be visible to a later build's index
+	// lookups.
+	if _, found := index.Lookup(content); !found {
+		t.Fatal("ChunkIndex did not record this build's chunk once Close succeeded")
+	}
+}